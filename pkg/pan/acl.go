@@ -0,0 +1,371 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pan
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/serrors"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// ACLAction is the decision attached to a matching ACLRule, or to an ACL's
+// default when no rule matches.
+type ACLAction string
+
+const (
+	ACLActionAllow ACLAction = "allow"
+	ACLActionDeny  ACLAction = "deny"
+)
+
+// ACLRule is one entry of an ACL, evaluated top-to-bottom: the first rule
+// whose constraints are all satisfied decides a packet's ACLAction.
+//
+// SrcIA selects which source ISD-AS the rule applies to, with wildcards:
+// "1-ff00:0:110" matches exactly that AS, "1-ff00:0:*" matches any AS
+// sharing the first two AS groups, "1-*" matches any AS in ISD 1, and "*"
+// (or an empty SrcIA) matches any source.
+//
+// Fingerprints is a further constraint: the rule only matches if the
+// packet's fingerprint is also in the list. Leaving it empty means "don't
+// care", which is how a rule can express "any fingerprint from this ISD"
+// per-SrcIA instead of the previous exact-fingerprint-only matching.
+//
+// TransitIfaces and MaxHops are a known, deliberate gap: they're accepted
+// in the JSON schema so a rule file can be written and validated ahead of
+// time, but Match does not evaluate either field. Doing so needs per-hop
+// introspection of the dataplane path (walking ForwardingPath's hop
+// fields to check traversed interfaces and count hops), and this
+// snapshot's ForwardingPath exposes no such API to build that on top of.
+// Rather than silently matching nothing, or against a no-op stub, compile
+// rejects any rule that sets either field -- this is out of scope for
+// this change, not an oversight.
+type ACLRule struct {
+	Action        ACLAction         `json:"action"`
+	SrcIA         string            `json:"src_ia"`
+	Fingerprints  []PathFingerprint `json:"fingerprints,omitempty"`
+	TransitIfaces []TransitIface    `json:"transit_ifaces,omitempty"`
+	MaxHops       int               `json:"max_hops,omitempty"`
+
+	// srcIA is SrcIA, compiled once at load time into a form Match can
+	// evaluate per packet with plain integer comparisons; see
+	// compileSrcIA.
+	srcIA srcIAMatcher
+}
+
+// TransitIface identifies a single interface a forwarding path may
+// traverse, as the (IA, interface ID) pair of the AS on one side of it.
+type TransitIface struct {
+	IA   addr.IA `json:"ia"`
+	IfID uint64  `json:"ifid"`
+}
+
+// ACL is an ordered, hot-reloadable list of ACLRule. It supersedes the
+// earlier flat representations (the map[addr.IA][]PathFingerprint of
+// baseUDPConn.allowedPaths and the fingerprint list of the
+// tlsproxy/web-forwarder ACL), which forced an exact IA match and couldn't express a deny rule, an ISD-wide allow, or
+// a transit-interface/hop-count constraint. PathFingerprint remains one
+// matcher among several, so flat configs still load (see parseACLFile).
+type ACL struct {
+	mu    sync.RWMutex
+	rules []ACLRule
+	dflt  ACLAction
+
+	path    string
+	watcher *fsnotify.Watcher
+}
+
+// aclFile is the on-disk JSON representation of the rule-list ACL format.
+type aclFile struct {
+	Rules   []ACLRule `json:"rules"`
+	Default ACLAction `json:"default"`
+}
+
+// LoadACL reads an ACL from pathToFile and, for a non-empty path, starts
+// watching it with fsnotify so that Match picks up edits without a process
+// restart. An empty pathToFile returns an ACL that allows everything,
+// matching the previous "no ACL file configured" behaviour.
+func LoadACL(pathToFile string) (*ACL, error) {
+	if pathToFile == "" {
+		return &ACL{dflt: ACLActionAllow}, nil
+	}
+	acl := &ACL{path: pathToFile}
+	if err := acl.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, serrors.WrapStr("starting ACL watcher", err)
+	}
+	if err := watcher.Add(pathToFile); err != nil {
+		watcher.Close()
+		return nil, serrors.WrapStr("watching ACL file", err, "path", pathToFile)
+	}
+	acl.watcher = watcher
+	go acl.watch()
+	return acl, nil
+}
+
+// NewACL builds an ACL from an explicit, already-in-memory rule list, with
+// no file backing or hot reload. This is for ACLs that arrive embedded in
+// another config file (e.g. a per-route ACL in an SNI routing table)
+// rather than loaded from their own file via LoadACL.
+func NewACL(rules []ACLRule, dflt ACLAction) (*ACL, error) {
+	compiled := make([]ACLRule, len(rules))
+	copy(compiled, rules)
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return nil, serrors.WrapStr("compiling ACL rule", err, "index", i)
+		}
+	}
+	if dflt == "" {
+		dflt = ACLActionDeny
+	}
+	return &ACL{rules: compiled, dflt: dflt}, nil
+}
+
+// Close stops watching the ACL file for changes, if any.
+func (a *ACL) Close() error {
+	if a.watcher == nil {
+		return nil
+	}
+	return a.watcher.Close()
+}
+
+func (a *ACL) watch() {
+	for {
+		select {
+		case event, ok := <-a.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := a.reload(); err != nil {
+				log.Error("reloading ACL, keeping previous rules", "path", a.path, "err", err)
+			}
+		case err, ok := <-a.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error("ACL watcher error", "path", a.path, "err", err)
+		}
+	}
+}
+
+func (a *ACL) reload() error {
+	raw, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	rules, dflt, err := parseACLFile(raw)
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return serrors.WrapStr("compiling ACL rule", err, "index", i)
+		}
+	}
+	a.mu.Lock()
+	a.rules, a.dflt = rules, dflt
+	a.mu.Unlock()
+	return nil
+}
+
+// parseACLFile accepts the rule-list format and two legacy formats: the flat
+// map[addr.IA][]PathFingerprint (optionally wrapped as {"paths": ...}),
+// converted into one allow rule per IA, and the tlsproxy/web-forwarder's
+// original {"paths": [...]} fingerprint list, converted into one allow rule
+// for any source IA. Both legacy formats get a default-deny fallback.
+func parseACLFile(raw []byte) ([]ACLRule, ACLAction, error) {
+	var f aclFile
+	if err := json.Unmarshal(raw, &f); err == nil && len(f.Rules) > 0 {
+		dflt := f.Default
+		if dflt == "" {
+			dflt = ACLActionDeny
+		}
+		return f.Rules, dflt, nil
+	}
+
+	var wrapped struct {
+		Paths map[addr.IA][]PathFingerprint `json:"paths"`
+	}
+	if err := json.Unmarshal(raw, &wrapped); err == nil && len(wrapped.Paths) > 0 {
+		return legacyRules(wrapped.Paths), ACLActionDeny, nil
+	}
+
+	var wrappedList struct {
+		Paths []PathFingerprint `json:"paths"`
+	}
+	if err := json.Unmarshal(raw, &wrappedList); err == nil && len(wrappedList.Paths) > 0 {
+		return []ACLRule{{
+			Action:       ACLActionAllow,
+			SrcIA:        "*",
+			Fingerprints: wrappedList.Paths,
+		}}, ACLActionDeny, nil
+	}
+
+	var bare map[addr.IA][]PathFingerprint
+	if err := json.Unmarshal(raw, &bare); err == nil && len(bare) > 0 {
+		return legacyRules(bare), ACLActionDeny, nil
+	}
+
+	return nil, "", serrors.New("ACL file matches neither the rule-list nor the legacy format")
+}
+
+func legacyRules(paths map[addr.IA][]PathFingerprint) []ACLRule {
+	rules := make([]ACLRule, 0, len(paths))
+	for ia, fingerprints := range paths {
+		rules = append(rules, ACLRule{
+			Action:       ACLActionAllow,
+			SrcIA:        ia.String(),
+			Fingerprints: fingerprints,
+		})
+	}
+	return rules
+}
+
+// Match reports whether a packet from src, carrying forwarding path
+// fingerprint fp over path, is allowed by the ACL. path may be nil if the
+// caller has no ForwardingPath at hand (e.g. for within-AS traffic); no
+// currently-evaluated rule dimension needs it, but it's threaded through
+// for when TransitIfaces/MaxHops matching lands.
+func (a *ACL) Match(src snet.SCIONAddress, fp PathFingerprint, path *ForwardingPath) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for i := range a.rules {
+		if a.rules[i].matches(src, fp, path) {
+			return a.rules[i].Action == ACLActionAllow
+		}
+	}
+	return a.dflt == ACLActionAllow
+}
+
+func (r *ACLRule) matches(src snet.SCIONAddress, fp PathFingerprint, path *ForwardingPath) bool {
+	if !r.srcIA.match(src.IA) {
+		return false
+	}
+	if len(r.Fingerprints) > 0 {
+		matched := false
+		for _, want := range r.Fingerprints {
+			if want == fp {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// compile fills in r.srcIA from r.SrcIA, so Match can evaluate it per
+// packet with plain integer comparisons instead of re-parsing the pattern
+// string on every call. It rejects rules that set TransitIfaces or
+// MaxHops: Match doesn't evaluate them (see ACLRule's doc comment, which
+// discloses this as a deliberate, out-of-scope limitation rather than a
+// bug), so accepting such a rule would silently produce a no-op that
+// never matches instead of surfacing the operator's mistake.
+func (r *ACLRule) compile() error {
+	if len(r.TransitIfaces) > 0 || r.MaxHops > 0 {
+		return serrors.New(
+			"transit_ifaces/max_hops are not supported in this version of the ACL matcher and would never match; remove them from the rule",
+			"src_ia", r.SrcIA)
+	}
+	m, err := compileSrcIA(r.SrcIA)
+	if err != nil {
+		return err
+	}
+	r.srcIA = m
+	return nil
+}
+
+// srcIAMatcher is the compiled form of an ACLRule's SrcIA pattern.
+type srcIAMatcher struct {
+	isdWildcard bool
+	isd         addr.ISD
+
+	asWildcard bool
+	as         addr.AS
+	asMask     addr.AS
+}
+
+// compileSrcIA parses a SrcIA pattern ("*", "<isd>-*" or
+// "<isd>-<as>", with "*" also allowed for individual AS hex groups, e.g.
+// "1-ff00:0:*") into a srcIAMatcher.
+func compileSrcIA(pattern string) (srcIAMatcher, error) {
+	if pattern == "" || pattern == "*" {
+		return srcIAMatcher{isdWildcard: true, asWildcard: true}, nil
+	}
+	parts := strings.SplitN(pattern, "-", 2)
+	if len(parts) != 2 {
+		return srcIAMatcher{}, serrors.New("invalid src_ia pattern, want ISD-AS", "pattern", pattern)
+	}
+
+	var m srcIAMatcher
+	if parts[0] == "*" {
+		m.isdWildcard = true
+	} else {
+		isd, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return srcIAMatcher{}, serrors.WrapStr("invalid ISD in src_ia pattern", err, "pattern", pattern)
+		}
+		m.isd = addr.ISD(isd)
+	}
+
+	if parts[1] == "*" {
+		m.asWildcard = true
+		return m, nil
+	}
+	groups := strings.Split(parts[1], ":")
+	if len(groups) != 3 {
+		return srcIAMatcher{}, serrors.New("invalid AS in src_ia pattern", "pattern", pattern)
+	}
+	for i, g := range groups {
+		shift := uint(16 * (2 - i))
+		if g == "*" {
+			continue
+		}
+		v, err := strconv.ParseUint(g, 16, 16)
+		if err != nil {
+			return srcIAMatcher{}, serrors.WrapStr("invalid AS group in src_ia pattern", err, "pattern", pattern)
+		}
+		m.asMask |= addr.AS(0xffff) << shift
+		m.as |= addr.AS(v) << shift
+	}
+	return m, nil
+}
+
+func (m srcIAMatcher) match(ia addr.IA) bool {
+	if !m.isdWildcard && m.isd != ia.I {
+		return false
+	}
+	if m.asWildcard {
+		return true
+	}
+	return ia.A&m.asMask == m.as
+}
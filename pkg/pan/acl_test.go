@@ -0,0 +1,159 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pan
+
+import (
+	"os"
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/snet"
+	snetpath "github.com/scionproto/scion/go/lib/snet/path"
+	"github.com/scionproto/scion/go/lib/xtest"
+)
+
+// benchmarkACLMatch mirrors benchmarkFilterPacket in raw_test.go: a handful
+// of rules, none of which are a fingerprint-only exact match for the
+// benchmarked packet, so every call walks the whole rule list and is
+// decided by its last rule.
+func benchmarkACLMatch(b *testing.B, path snetpath.SCION) {
+	acl := &ACL{dflt: ACLActionDeny}
+	for _, r := range []ACLRule{
+		{Action: ACLActionDeny, SrcIA: "2-*"},
+		{Action: ACLActionDeny, SrcIA: "1-ff00:0:113"},
+		{Action: ACLActionAllow, SrcIA: "1-ff00:0:*"},
+	} {
+		if err := r.compile(); err != nil {
+			b.Fatal(err)
+		}
+		acl.rules = append(acl.rules, r)
+	}
+
+	src := snet.SCIONAddress{IA: xtest.MustParseIA("1-ff00:0:112")}
+	fp := ForwardingPath{dataplanePath: path}
+	fprint := fp.Fingerprint()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		acl.Match(src, fprint, &fp)
+	}
+}
+
+func BenchmarkACLMatchLong(b *testing.B) {
+	benchmarkACLMatch(b, setupPacketLong())
+}
+func BenchmarkACLMatchThreeSeg(b *testing.B) {
+	benchmarkACLMatch(b, setupPacketThreeSeg())
+}
+func BenchmarkACLMatchShort(b *testing.B) {
+	benchmarkACLMatch(b, setupPacketShort())
+}
+
+func TestACLMatchOrderingAndWildcards(t *testing.T) {
+	acl, err := NewACL([]ACLRule{
+		{Action: ACLActionDeny, SrcIA: "1-ff00:0:113"},
+		{Action: ACLActionAllow, SrcIA: "1-ff00:0:*"},
+		{Action: ACLActionAllow, SrcIA: "2-*"},
+	}, ACLActionDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ia   string
+		want bool
+	}{
+		{"1-ff00:0:113", false}, // exact deny, first match wins
+		{"1-ff00:0:112", true},  // AS-group wildcard allow
+		{"2-ff00:0:1", true},    // ISD wildcard allow
+		{"3-ff00:0:1", false},   // no rule matches, falls to default deny
+	}
+	for _, c := range cases {
+		src := snet.SCIONAddress{IA: xtest.MustParseIA(c.ia)}
+		if got := acl.Match(src, PathFingerprint{}, nil); got != c.want {
+			t.Errorf("Match(%s) = %v, want %v", c.ia, got, c.want)
+		}
+	}
+}
+
+func TestACLMatchFingerprint(t *testing.T) {
+	fp := PathFingerprint{0x01}
+	acl, err := NewACL([]ACLRule{
+		{Action: ACLActionAllow, SrcIA: "*", Fingerprints: []PathFingerprint{fp}},
+	}, ACLActionDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := snet.SCIONAddress{IA: xtest.MustParseIA("1-ff00:0:110")}
+	if !acl.Match(src, fp, nil) {
+		t.Error("matching fingerprint should be allowed")
+	}
+	if acl.Match(src, PathFingerprint{0x02}, nil) {
+		t.Error("non-matching fingerprint should fall through to default deny")
+	}
+}
+
+func TestACLRuleCompileRejectsUnsupportedFields(t *testing.T) {
+	if _, err := NewACL([]ACLRule{
+		{Action: ACLActionAllow, SrcIA: "*", TransitIfaces: []TransitIface{{IfID: 1}}},
+	}, ACLActionDeny); err == nil {
+		t.Error("a rule with TransitIfaces set should be rejected, not silently ignored")
+	}
+	if _, err := NewACL([]ACLRule{
+		{Action: ACLActionAllow, SrcIA: "*", MaxHops: 3},
+	}, ACLActionDeny); err == nil {
+		t.Error("a rule with MaxHops set should be rejected, not silently ignored")
+	}
+}
+
+func TestParseACLFileLegacyFormat(t *testing.T) {
+	raw := []byte(`{"paths": {"1-ff00:0:110": []}}`)
+	rules, dflt, err := parseACLFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dflt != ACLActionDeny {
+		t.Errorf("legacy format should default-deny, got %v", dflt)
+	}
+	if len(rules) != 1 || rules[0].Action != ACLActionAllow || rules[0].SrcIA != "1-ff00:0:110" {
+		t.Errorf("unexpected rules from legacy format: %+v", rules)
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/acl.json"
+	if err := os.WriteFile(path, []byte(`{"rules":[{"action":"deny","src_ia":"*"}],"default":"deny"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	acl := &ACL{path: path}
+	if err := acl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	src := snet.SCIONAddress{IA: xtest.MustParseIA("1-ff00:0:110")}
+	if acl.Match(src, PathFingerprint{}, nil) {
+		t.Fatal("expected the initial rules to deny")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules":[{"action":"allow","src_ia":"*"}],"default":"deny"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Match(src, PathFingerprint{}, nil) {
+		t.Fatal("expected reload to pick up the new allow rule")
+	}
+}
@@ -48,8 +48,20 @@ type Pinger struct {
 	conn  snet.PacketConn
 	local *snet.UDPAddr
 	pld   []byte
+
+	// registry lets other probers sharing this Pinger's socket (currently
+	// only Tracerouter) receive the SCMP payloads addressed to them; see
+	// scmpHandler.Handle.
+	registry *scmpRegistry
 }
 
+// NewPinger creates a Pinger that sends and receives SCMP echo packets
+// through the reliable-socket dispatcher.
+//
+// Deprecated: upstream SCION is removing the dispatcher in favour of
+// endhosts binding directly to a UDP port range, with SCMP received on the
+// same socket. Use NewPingerFromConn instead; this constructor is kept only
+// for callers that still run alongside a dispatcher.
 func NewPinger(ctx context.Context,
 	dispatcher reliable.Dispatcher,
 	local *snet.UDPAddr,
@@ -57,12 +69,14 @@ func NewPinger(ctx context.Context,
 
 	id := rand.Uint64()
 	replies := make(chan Reply, 10)
+	registry := newSCMPRegistry()
 
 	svc := snet.DefaultPacketDispatcherService{
 		Dispatcher: dispatcher,
 		SCMPHandler: scmpHandler{
-			id:      uint16(id),
-			replies: replies,
+			id:       uint16(id),
+			replies:  replies,
+			registry: registry,
 		},
 	}
 	conn, port, err := svc.Register(ctx, local.IA, local.Host, addr.SvcNone)
@@ -80,9 +94,130 @@ func NewPinger(ctx context.Context,
 		conn:       conn,
 		local:      local,
 		pld:        make([]byte, 8), // min payload size
+		registry:   registry,
+	}, nil
+}
+
+// NewPingerFromConn creates a Pinger that sends and receives SCMP echo
+// packets directly over conn, with no reliable-socket dispatcher involved.
+// conn is expected to be a raw UDP socket bound to local's host, as opened
+// by openUDPConn; SCMP echo replies and errors are demultiplexed from
+// ordinary data on conn by inspecting the SCION L4 header, and fed into the
+// Replies channel exactly as the dispatcher-based constructor does.
+func NewPingerFromConn(ctx context.Context, local *snet.UDPAddr, conn *net.UDPConn) (*Pinger, error) {
+	id := rand.Uint64()
+	replies := make(chan Reply, 10)
+	registry := newSCMPRegistry()
+
+	local = local.Copy()
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		local.Host.Port = udpAddr.Port
+	}
+
+	return &Pinger{
+		Replies:    replies,
+		errHandler: nil,
+		id:         id,
+		conn: &rawConn{
+			conn: conn,
+			scmp: scmpHandler{id: uint16(id), replies: replies, registry: registry},
+		},
+		local:    local,
+		pld:      make([]byte, 8), // min payload size
+		registry: registry,
 	}, nil
 }
 
+// NewPingerPortRange creates a dispatcher-less Pinger the way a real
+// endhost is expected to: it opens its own raw UDP socket via openUDPConn,
+// bound to the first free port in portRange (or a kernel-assigned
+// ephemeral port if portRange is empty), and hands it to NewPingerFromConn.
+// Use this instead of NewPingerFromConn unless the caller already has its
+// own net.UDPConn to reuse.
+func NewPingerPortRange(ctx context.Context, local *snet.UDPAddr, portRange []uint16) (*Pinger, error) {
+	conn, err := openUDPConn(local, portRange)
+	if err != nil {
+		return nil, serrors.WrapStr("opening dispatcher-less socket", err)
+	}
+	pinger, err := NewPingerFromConn(ctx, local, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return pinger, nil
+}
+
+// openUDPConn opens a raw UDP socket bound to local.Host.IP, for use with
+// NewPingerFromConn. If portRange is non-empty, the first free port in the
+// range is used, mirroring the port range endhosts are expected to bind
+// within once the dispatcher is gone; an empty portRange falls back to
+// a kernel-assigned ephemeral port.
+func openUDPConn(local *snet.UDPAddr, portRange []uint16) (*net.UDPConn, error) {
+	if len(portRange) == 0 {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: local.Host.IP})
+	}
+	var lastErr error
+	for _, port := range portRange {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.Host.IP, Port: int(port)})
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, serrors.WrapStr("no free port in range", lastErr,
+		"first", portRange[0], "last", portRange[len(portRange)-1])
+}
+
+// rawConn implements snet.PacketConn directly over a UDP socket, with no
+// reliable-socket dispatcher in between: the serialized SCION packet
+// (underlay header included) is written/read as the entire UDP payload,
+// exactly as a border router or endhost exchanges it once the dispatcher is
+// gone. SCMP echo replies, traceroute replies and the two interface-down
+// errors are intercepted and handed to scmp instead of being returned to
+// the caller; other SCMP message types are dropped along with plain data.
+type rawConn struct {
+	conn *net.UDPConn
+	scmp scmpHandler
+}
+
+func (c *rawConn) WriteTo(pkt *snet.Packet, ov *net.UDPAddr) error {
+	if err := pkt.Serialize(); err != nil {
+		return serrors.WrapStr("serializing SCION packet", err)
+	}
+	_, err := c.conn.WriteTo(pkt.Bytes, ov)
+	return err
+}
+
+func (c *rawConn) ReadFrom(pkt *snet.Packet, ov *net.UDPAddr) error {
+	buf := make([]byte, common.MaxMTU)
+	n, remote, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		return err
+	}
+	if ov != nil && remote != nil {
+		*ov = *remote
+	}
+	pkt.Bytes = append(pkt.Bytes[:0], buf[:n]...)
+	if err := pkt.Decode(); err != nil {
+		return serrors.WrapStr("decoding SCION packet", err)
+	}
+	switch pkt.Payload.(type) {
+	case snet.SCMPEchoReply, snet.SCMPTracerouteReply,
+		snet.SCMPExternalInterfaceDown, snet.SCMPInternalConnectivityDown:
+		return c.scmp.Handle(pkt)
+	default:
+		// Plain data, or an SCMP message type the Pinger doesn't handle;
+		// nothing else to do, the Pinger has no use for it.
+		return nil
+	}
+}
+
+func (c *rawConn) Close() error { return c.conn.Close() }
+
+func (c *rawConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *rawConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+func (c *rawConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+
 func (p *Pinger) Send(ctx context.Context, remote *snet.UDPAddr,
 	sequence uint16, size int) error {
 
@@ -174,11 +309,29 @@ func (e InternalConnectivityDownError) Error() string {
 }
 
 type scmpHandler struct {
-	id      uint16
-	replies chan<- Reply
+	id       uint16
+	replies  chan<- Reply
+	registry *scmpRegistry
 }
 
 func (h scmpHandler) Handle(pkt *snet.Packet) error {
+	switch pkt.Payload.(type) {
+	case snet.SCMPTracerouteReply:
+		// Traceroute replies always belong to whichever Tracerouter sent
+		// the probe, never to this Pinger's echo loop.
+		if h.registry != nil && h.registry.dispatch(pkt) {
+			return nil
+		}
+	case snet.SCMPExternalInterfaceDown, snet.SCMPInternalConnectivityDown:
+		// These errors report a dropped packet rather than echoing back an
+		// identifier, so we can't tell which prober it was meant for;
+		// broadcast to every attached Tracerouter in addition to handling
+		// it below for the Pinger's own Replies channel, same as before.
+		if h.registry != nil {
+			h.registry.broadcast(pkt)
+		}
+	}
+
 	echo, err := h.handle(pkt)
 	h.replies <- Reply{
 		Received: time.Now(),
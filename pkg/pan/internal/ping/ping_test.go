@@ -0,0 +1,93 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/xtest"
+)
+
+func TestOpenUDPConnEphemeralPort(t *testing.T) {
+	local := &snet.UDPAddr{Host: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}
+	conn, err := openUDPConn(local, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().(*net.UDPAddr).Port == 0 {
+		t.Fatal("expected the kernel to assign a non-zero ephemeral port")
+	}
+}
+
+func TestOpenUDPConnPortRange(t *testing.T) {
+	local := &snet.UDPAddr{Host: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}
+
+	// A port already bound must be skipped in favor of the next one in
+	// range.
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.Host.IP, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := uint16(taken.LocalAddr().(*net.UDPAddr).Port)
+
+	conn, err := openUDPConn(local, []uint16{takenPort, takenPort + 1})
+	if err != nil {
+		t.Fatalf("expected a free port in range to be found: %v", err)
+	}
+	defer conn.Close()
+	if got := uint16(conn.LocalAddr().(*net.UDPAddr).Port); got != takenPort+1 {
+		t.Fatalf("bound port = %d, want %d (the range's only free port)", got, takenPort+1)
+	}
+}
+
+func TestOpenUDPConnPortRangeExhausted(t *testing.T) {
+	local := &snet.UDPAddr{Host: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}
+
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.Host.IP, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := uint16(taken.LocalAddr().(*net.UDPAddr).Port)
+
+	if _, err := openUDPConn(local, []uint16{takenPort}); err == nil {
+		t.Fatal("expected an error when every port in range is taken")
+	}
+}
+
+func TestNewPingerPortRangeBindsWithinRange(t *testing.T) {
+	local := &snet.UDPAddr{IA: xtest.MustParseIA("1-ff00:0:110"), Host: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}
+
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.Host.IP, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := uint16(taken.LocalAddr().(*net.UDPAddr).Port)
+
+	pinger, err := NewPingerPortRange(context.Background(), local, []uint16{takenPort, takenPort + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinger.Close()
+	if pinger.local.Host.Port != int(takenPort+1) {
+		t.Fatalf("pinger bound to port %d, want %d (the range's only free port)", pinger.local.Host.Port, takenPort+1)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ping
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/serrors"
+	"github.com/scionproto/scion/go/lib/slayers/path/scion"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+	"github.com/scionproto/scion/go/lib/topology/underlay"
+)
+
+// PathInterface identifies one (IA, interface ID) pair a traceroute probe
+// reported as its terminating hop.
+type PathInterface struct {
+	IA   addr.IA
+	IfID common.IFIDType
+}
+
+// TraceReply is one hop's reply to a Tracerouter probe. Error is set
+// instead of Interface/RTT either when the hop reported an SCMP error
+// (e.g. ExternalInterfaceDownError) instead of a traceroute reply, or, with
+// the sentinel errNoReply, when no reply of any kind arrived before the
+// probe's timeout.
+type TraceReply struct {
+	Hop       int
+	Interface PathInterface
+	RTT       time.Duration
+	Error     error
+}
+
+var errNoReply = serrors.New("no reply")
+
+// pendingProbe tracks the single in-flight traceroute probe a Tracerouter
+// is waiting a reply for. seq is the SCMPTracerouteRequest's Sequence, the
+// only thing that ties a reply back to the hop that caused it: every probe
+// of a Trace call shares the same Tracerouter identifier, so the identifier
+// alone can't tell a fresh reply for the current hop from a stale one that
+// arrived late for a hop that already timed out.
+type pendingProbe struct {
+	hop  int
+	seq  uint16
+	sent time.Time
+	done chan struct{}
+}
+
+// Tracerouter sends SCMP traceroute requests hop-by-hop along a path,
+// sharing the underlying socket (and SCMP demultiplexing) of the Pinger it
+// is built from. Unlike the Pinger, which may have many echo probes in
+// flight at once, a Tracerouter probes one hop at a time: Trace waits for a
+// reply (or a timeout) before moving on to the next hop, so a single
+// in-flight probe is all the bookkeeping it needs.
+type Tracerouter struct {
+	TraceReplies <-chan TraceReply
+
+	pinger *Pinger
+	id     uint16
+
+	traceReplies chan TraceReply
+
+	mu      sync.Mutex
+	pending *pendingProbe
+}
+
+// NewTracerouter creates a Tracerouter that reuses pinger's socket. It
+// shares neither an identifier nor a Replies channel with pinger's own echo
+// probes, so the two can be used concurrently. Call Close when done with
+// it; closing pinger also detaches any Tracerouter built from it.
+func NewTracerouter(pinger *Pinger) *Tracerouter {
+	traceReplies := make(chan TraceReply, 10)
+	t := &Tracerouter{
+		TraceReplies: traceReplies,
+		pinger:       pinger,
+		id:           uint16(rand.Uint32()),
+		traceReplies: traceReplies,
+	}
+	pinger.registry.register(t.id, t)
+	return t
+}
+
+// Close detaches the Tracerouter from its Pinger's socket.
+func (t *Tracerouter) Close() {
+	t.pinger.registry.unregister(t.id)
+}
+
+// Trace sends one SCMP traceroute probe per hop along the path carried in
+// remote.Path, from the first hop up to the last, waiting up to timeout for
+// each hop's reply before probing the next one. It sends exactly one
+// TraceReply per hop on t.TraceReplies -- an error one if the probe could
+// not be sent, timed out (Error will be errNoReply), or got back an SCMP
+// error instead of a traceroute reply.
+func (t *Tracerouter) Trace(ctx context.Context, remote *snet.UDPAddr, timeout time.Duration) error {
+	numHops, err := pathHops(remote.Path)
+	if err != nil {
+		return serrors.WrapStr("decoding path for traceroute", err)
+	}
+
+	for hop := 1; hop <= numHops; hop++ {
+		seq := uint16(hop)
+		probePath, err := truncateAt(remote.Path, hop)
+		if err != nil {
+			t.traceReplies <- TraceReply{Hop: hop, Error: err}
+			continue
+		}
+		probe := remote.Copy()
+		probe.Path = probePath
+
+		pp := &pendingProbe{hop: hop, seq: seq, sent: time.Now(), done: make(chan struct{})}
+		t.mu.Lock()
+		t.pending = pp
+		t.mu.Unlock()
+
+		if err := t.send(probe, seq); err != nil {
+			t.clear(pp)
+			t.traceReplies <- TraceReply{Hop: hop, Error: err}
+			continue
+		}
+
+		select {
+		case <-pp.done:
+		case <-time.After(timeout):
+			if t.clear(pp) {
+				t.traceReplies <- TraceReply{Hop: hop, Error: errNoReply}
+			}
+		case <-ctx.Done():
+			t.clear(pp)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (t *Tracerouter) send(remote *snet.UDPAddr, seq uint16) error {
+	pkt, err := packTraceroute(t.pinger.local, remote, snet.SCMPTracerouteRequest{
+		Identifier: t.id,
+		Sequence:   seq,
+	})
+	if err != nil {
+		return err
+	}
+	nextHop := remote.NextHop
+	if nextHop == nil && t.pinger.local.IA.Equal(remote.IA) {
+		nextHop = &net.UDPAddr{
+			IP:   remote.Host.IP,
+			Port: underlay.EndhostPort,
+			Zone: remote.Host.Zone,
+		}
+	}
+	return t.pinger.conn.WriteTo(pkt, nextHop)
+}
+
+// clear removes pp from t.pending if it is still the current probe,
+// reporting whether it did so; false means pp was already resolved by
+// handleReply/handleError racing with the timeout/cancellation in Trace.
+func (t *Tracerouter) clear(pp *pendingProbe) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending != pp {
+		return false
+	}
+	t.pending = nil
+	return true
+}
+
+// take removes and returns the current pending probe, if any.
+func (t *Tracerouter) take() *pendingProbe {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pp := t.pending
+	t.pending = nil
+	return pp
+}
+
+// takeMatching removes and returns the current pending probe only if its
+// seq matches, leaving it in place otherwise. A mismatch means reply is a
+// stale SCMPTracerouteReply for a hop that already timed out: the current
+// probe (a later hop) must not be resolved by it.
+func (t *Tracerouter) takeMatching(seq uint16) *pendingProbe {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil || t.pending.seq != seq {
+		return nil
+	}
+	pp := t.pending
+	t.pending = nil
+	return pp
+}
+
+// handleReply resolves the pending probe with a successful traceroute
+// reply. Called from scmpRegistry.dispatch, on the socket's single read
+// goroutine.
+func (t *Tracerouter) handleReply(reply snet.SCMPTracerouteReply) {
+	pp := t.takeMatching(reply.Sequence)
+	if pp == nil {
+		return // no probe in flight, or it's not for the current hop; drop it
+	}
+	t.traceReplies <- TraceReply{
+		Hop: pp.hop,
+		Interface: PathInterface{
+			IA:   reply.IA,
+			IfID: common.IFIDType(reply.Interface),
+		},
+		RTT: time.Since(pp.sent),
+	}
+	close(pp.done)
+}
+
+// handleError resolves the pending probe with a router-reported error.
+// Called from scmpRegistry.broadcast: since these SCMP errors don't echo
+// back an identifier, every attached Tracerouter sees every one and
+// resolves its own pending probe (if any) with it, on the assumption -
+// true for Trace's one-hop-at-a-time probing - that at most one probe is
+// ever in flight at a time.
+func (t *Tracerouter) handleError(pkt *snet.Packet) {
+	pp := t.take()
+	if pp == nil {
+		return
+	}
+	var err error
+	switch s := pkt.Payload.(type) {
+	case snet.SCMPExternalInterfaceDown:
+		err = ExternalInterfaceDownError{s, pkt.Path}
+	case snet.SCMPInternalConnectivityDown:
+		err = InternalConnectivityDownError{s, pkt.Path}
+	default:
+		return
+	}
+	t.traceReplies <- TraceReply{Hop: pp.hop, Error: err}
+	close(pp.done)
+}
+
+// scmpRegistry demultiplexes inbound SCMP payloads that a plain Pinger
+// doesn't consume to whichever Tracerouter owns them, so a Tracerouter can
+// share a Pinger's socket and single read loop instead of needing its own.
+type scmpRegistry struct {
+	mu   sync.Mutex
+	byID map[uint16]*Tracerouter
+}
+
+func newSCMPRegistry() *scmpRegistry {
+	return &scmpRegistry{byID: make(map[uint16]*Tracerouter)}
+}
+
+func (r *scmpRegistry) register(id uint16, t *Tracerouter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byID[id] = t
+}
+
+func (r *scmpRegistry) unregister(id uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byID, id)
+}
+
+// dispatch routes an SCMPTracerouteReply to the Tracerouter that owns its
+// identifier, reporting whether one was found.
+func (r *scmpRegistry) dispatch(pkt *snet.Packet) bool {
+	reply, ok := pkt.Payload.(snet.SCMPTracerouteReply)
+	if !ok {
+		return false
+	}
+	r.mu.Lock()
+	t := r.byID[reply.Identifier]
+	r.mu.Unlock()
+	if t == nil {
+		return false
+	}
+	t.handleReply(reply)
+	return true
+}
+
+// broadcast hands pkt to every currently attached Tracerouter.
+func (r *scmpRegistry) broadcast(pkt *snet.Packet) {
+	r.mu.Lock()
+	tracerouters := make([]*Tracerouter, 0, len(r.byID))
+	for _, t := range r.byID {
+		tracerouters = append(tracerouters, t)
+	}
+	r.mu.Unlock()
+	for _, t := range tracerouters {
+		t.handleError(pkt)
+	}
+}
+
+func packTraceroute(local, remote *snet.UDPAddr, req snet.SCMPTracerouteRequest) (*snet.Packet, error) {
+	if remote.Path.IsEmpty() && !local.IA.Equal(remote.IA) {
+		return nil, serrors.New("no path for remote ISD-AS", "local", local.IA, "remote", remote.IA)
+	}
+	pkt := &snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Destination: snet.SCIONAddress{
+				IA:   remote.IA,
+				Host: addr.HostFromIP(remote.Host.IP),
+			},
+			Source: snet.SCIONAddress{
+				IA:   local.IA,
+				Host: addr.HostFromIP(local.Host.IP),
+			},
+			Path:    remote.Path,
+			Payload: req,
+		},
+	}
+	return pkt, nil
+}
+
+// pathHops reports the number of hop fields (i.e. the number of possible
+// traceroute targets) in raw's SCION dataplane path.
+func pathHops(raw spath.Path) (int, error) {
+	decoded, err := decodeSCIONPath(raw)
+	if err != nil {
+		return 0, err
+	}
+	return len(decoded.HopFields), nil
+}
+
+func decodeSCIONPath(raw spath.Path) (*scion.Decoded, error) {
+	if raw.Type != scion.PathType {
+		return nil, serrors.New("traceroute only supports the SCION dataplane path type",
+			"type", raw.Type)
+	}
+	decoded := &scion.Decoded{}
+	if err := decoded.DecodeFromBytes(raw.Raw); err != nil {
+		return nil, serrors.WrapStr("decoding path", err)
+	}
+	return decoded, nil
+}
+
+// truncateAt clones raw and rewrites its PathMeta (CurrINF, CurrHF and
+// SegLen) so it terminates after the hop-th hop field (1-indexed): each
+// on-path router decrements the current segment's length and advances
+// CurrHF as it forwards, so shortening SegLen to end exactly at hop causes
+// that router to respond with an SCMP traceroute reply instead of
+// forwarding further.
+//
+// Known gap: peering paths are not supported. Peering paths encode the
+// peering link's hop field at the tail of one segment and the head of the
+// next -- the same physical link represented twice, once from each
+// segment's perspective -- which a plain "sum the SegLens" truncation
+// doesn't account for correctly. Rather than produce a silently garbled
+// path for that case, truncateAt rejects it outright with an error;
+// plain up/down and shortcut (non-peering) paths, where this doesn't
+// arise, are truncated exactly. Tracing a peering path is left
+// unimplemented rather than attempted, and should be called out as such
+// wherever this package's path coverage is described.
+func truncateAt(raw spath.Path, hop int) (spath.Path, error) {
+	decoded, err := decodeSCIONPath(raw)
+	if err != nil {
+		return spath.Path{}, err
+	}
+	if hop < 1 || hop > len(decoded.HopFields) {
+		return spath.Path{}, serrors.New("hop out of range",
+			"hop", hop, "numHops", len(decoded.HopFields))
+	}
+	for i := 0; i < int(decoded.NumINF); i++ {
+		if decoded.InfoFields[i].Peer {
+			return spath.Path{}, serrors.New(
+				"traceroute does not yet support peering path segments",
+				"hop", hop, "segment", i)
+		}
+	}
+
+	seg, segStart := 0, 0
+	for seg < int(decoded.NumINF)-1 && hop > segStart+int(decoded.PathMeta.SegLen[seg]) {
+		segStart += int(decoded.PathMeta.SegLen[seg])
+		seg++
+	}
+
+	decoded.NumINF = seg + 1
+	decoded.InfoFields = decoded.InfoFields[:seg+1]
+	decoded.NumHops = hop
+	decoded.HopFields = decoded.HopFields[:hop]
+	decoded.PathMeta.CurrINF = uint8(seg)
+	decoded.PathMeta.CurrHF = uint8(hop - 1)
+	decoded.PathMeta.SegLen[seg] = uint8(hop - segStart)
+	for i := seg + 1; i < len(decoded.PathMeta.SegLen); i++ {
+		decoded.PathMeta.SegLen[i] = 0
+	}
+
+	buf := make([]byte, decoded.Len())
+	if err := decoded.SerializeTo(buf); err != nil {
+		return spath.Path{}, serrors.WrapStr("serializing truncated path", err)
+	}
+	return spath.Path{Type: raw.Type, Raw: buf}, nil
+}
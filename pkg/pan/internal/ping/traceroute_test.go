@@ -0,0 +1,72 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ping
+
+import (
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/xtest"
+)
+
+func newTestTracerouter(hop int, seq uint16) *Tracerouter {
+	traceReplies := make(chan TraceReply, 10)
+	return &Tracerouter{
+		TraceReplies: traceReplies,
+		traceReplies: traceReplies,
+		pending:      &pendingProbe{hop: hop, seq: seq, sent: time.Now(), done: make(chan struct{})},
+	}
+}
+
+func TestHandleReplyDropsMismatchedSequence(t *testing.T) {
+	tr := newTestTracerouter(3, 7)
+
+	// A stale reply for an earlier, already-timed-out hop must not resolve
+	// the probe that's actually pending.
+	tr.handleReply(snet.SCMPTracerouteReply{Identifier: 1, Sequence: 6})
+
+	select {
+	case r := <-tr.traceReplies:
+		t.Fatalf("stale reply must not produce a TraceReply, got %+v", r)
+	default:
+	}
+	if tr.pending == nil {
+		t.Fatal("mismatched reply must leave the pending probe in place")
+	}
+}
+
+func TestHandleReplyResolvesMatchingSequence(t *testing.T) {
+	tr := newTestTracerouter(3, 7)
+	ia := xtest.MustParseIA("1-ff00:0:110")
+
+	tr.handleReply(snet.SCMPTracerouteReply{Identifier: 1, Sequence: 7, IA: ia, Interface: 42})
+
+	select {
+	case r := <-tr.traceReplies:
+		if r.Hop != 3 {
+			t.Fatalf("got hop %d, want 3", r.Hop)
+		}
+		if r.Interface.IA != ia || r.Interface.IfID != common.IFIDType(42) {
+			t.Fatalf("got interface %+v, want IA=%v IfID=42", r.Interface, ia)
+		}
+	default:
+		t.Fatal("matching reply must produce a TraceReply")
+	}
+	if tr.pending != nil {
+		t.Fatal("matching reply must clear the pending probe")
+	}
+}
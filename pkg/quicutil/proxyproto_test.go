@@ -0,0 +1,137 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quicutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/xtest"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+)
+
+// fakeSCIONAddr implements scionSource and scionFingerprinter for tests,
+// standing in for *pan.UDPAddr.
+type fakeSCIONAddr struct {
+	ia addr.IA
+	ip net.IP
+	fp pan.PathFingerprint
+}
+
+func (a fakeSCIONAddr) Network() string                  { return "scion" }
+func (a fakeSCIONAddr) String() string                   { return a.ia.String() }
+func (a fakeSCIONAddr) IA() addr.IA                      { return a.ia }
+func (a fakeSCIONAddr) IP() net.IP                       { return a.ip }
+func (a fakeSCIONAddr) Fingerprint() pan.PathFingerprint { return a.fp }
+
+func TestBuildProxyProtocolV2Structure(t *testing.T) {
+	remote := fakeSCIONAddr{
+		ia: xtest.MustParseIA("1-ff00:0:110"),
+		ip: net.ParseIP("127.0.0.1"),
+		fp: pan.PathFingerprint{0x01, 0x02},
+	}
+
+	hdr, err := BuildProxyProtocolV2(remote, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(hdr[:12], proxyProtoV2Signature[:]) {
+		t.Fatal("header does not start with the PROXY v2 signature")
+	}
+	if hdr[12] != proxyProtoV2VerCmd {
+		t.Fatalf("ver_cmd = %#x, want %#x", hdr[12], proxyProtoV2VerCmd)
+	}
+	if hdr[13] != proxyProtoV2FamTCP6 {
+		t.Fatalf("fam = %#x, want %#x", hdr[13], proxyProtoV2FamTCP6)
+	}
+	length := binary.BigEndian.Uint16(hdr[14:16])
+	if int(length) != len(hdr)-16 {
+		t.Fatalf("declared length %d does not match body length %d", length, len(hdr)-16)
+	}
+
+	body := hdr[16:]
+	if len(body) < addrBlockLenTCP6 {
+		t.Fatalf("body shorter than the TCP6 address block: %d bytes", len(body))
+	}
+	tlvs := body[addrBlockLenTCP6:]
+
+	seen := map[byte][]byte{}
+	for len(tlvs) >= 3 {
+		typ := tlvs[0]
+		l := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		tlvs = tlvs[3:]
+		if len(tlvs) < l {
+			t.Fatalf("truncated TLV body for type %#x", typ)
+		}
+		seen[typ] = tlvs[:l]
+		tlvs = tlvs[l:]
+	}
+
+	ia, ok := seen[tlvTypeIA]
+	if !ok || len(ia) != 8 || addr.IAInt(binary.BigEndian.Uint64(ia)).IA() != remote.ia {
+		t.Fatalf("tlvTypeIA = %v, want the 8-byte encoding of %v", ia, remote.ia)
+	}
+	fp, ok := seen[tlvTypeFingerprint]
+	if !ok || !bytes.Equal(fp, remote.fp[:]) {
+		t.Fatalf("tlvTypeFingerprint = %v, want %v", fp, remote.fp[:])
+	}
+	if _, ok := seen[tlvTypeSCIONAddr]; !ok {
+		t.Fatal("missing tlvTypeSCIONAddr")
+	}
+}
+
+func TestBuildProxyProtocolV2RejectsNonSCIONAddr(t *testing.T) {
+	if _, err := BuildProxyProtocolV2(&net.TCPAddr{}, 0, 0); err == nil {
+		t.Fatal("a non-SCION remote address should be rejected")
+	}
+}
+
+func TestParseProxyProtocolV2RoundTrip(t *testing.T) {
+	remote := fakeSCIONAddr{
+		ia: xtest.MustParseIA("1-ff00:0:110"),
+		ip: net.ParseIP("127.0.0.1"),
+		fp: pan.PathFingerprint{0x01, 0x02},
+	}
+
+	hdr, err := BuildProxyProtocolV2(remote, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseProxyProtocolV2(bytes.NewReader(hdr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.IA != remote.ia {
+		t.Fatalf("IA = %v, want %v", parsed.IA, remote.ia)
+	}
+	if parsed.SCIONAddr != remote.String() {
+		t.Fatalf("SCIONAddr = %q, want %q", parsed.SCIONAddr, remote.String())
+	}
+	if !parsed.HasFingerprint || parsed.Fingerprint != remote.fp {
+		t.Fatalf("Fingerprint = %v (has=%v), want %v", parsed.Fingerprint, parsed.HasFingerprint, remote.fp)
+	}
+}
+
+func TestParseProxyProtocolV2RejectsBadSignature(t *testing.T) {
+	if _, err := ParseProxyProtocolV2(bytes.NewReader(make([]byte, 16))); err == nil {
+		t.Fatal("a header with no valid PROXY v2 signature should be rejected")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// clientHelloRecordHeaderSize is the length of a TLS record header: content
+// type (1), protocol version (2), record length (2).
+const clientHelloRecordHeaderSize = 5
+
+// maxTLSRecordSize is the largest length a TLS record header can carry (the
+// length field is 16 bits); a ClientHello that claims more than this is
+// malformed, not just large.
+const maxTLSRecordSize = 1<<16 - 1
+
+// errNoSNI is returned when the ClientHello carries no server_name extension.
+var errNoSNI = errors.New("clienthello: no SNI extension")
+
+// peekSNI buffers the leading TLS handshake record of r and extracts the
+// requested server name from the ClientHello, without terminating TLS. The
+// returned reader yields the buffered bytes followed by the remainder of r,
+// so the ClientHello can be replayed to the backend unchanged.
+//
+// The buffer is sized from the record's own length header rather than a
+// fixed cap: ClientHellos carrying a post-quantum hybrid key share (e.g.
+// X25519Kyber768, on by default in current Chrome) routinely exceed 4KB,
+// and a fixed-size bufio.Reader would reject those with bufio.ErrBufferFull
+// -- indistinguishable from a genuinely malformed ClientHello.
+func peekSNI(r io.Reader) (sni string, replay *bufio.Reader, err error) {
+	br := bufio.NewReaderSize(r, clientHelloRecordHeaderSize)
+	hdr, err := br.Peek(clientHelloRecordHeaderSize)
+	if err != nil {
+		return "", br, err
+	}
+	if hdr[0] != 0x16 {
+		return "", br, errors.New("clienthello: not a TLS handshake record")
+	}
+	recLen := int(binary.BigEndian.Uint16(hdr[3:5]))
+	if recLen > maxTLSRecordSize {
+		return "", br, errors.New("clienthello: record length exceeds the TLS maximum")
+	}
+
+	// bufio.Reader's buffer size is fixed at construction, so grow it to
+	// fit the whole record before peeking again; br's own buffered header
+	// bytes are preserved since they're read back out of br itself.
+	br = bufio.NewReaderSize(br, clientHelloRecordHeaderSize+recLen)
+	record, err := br.Peek(clientHelloRecordHeaderSize + recLen)
+	if err != nil {
+		return "", br, err
+	}
+	sni, err = parseClientHelloSNI(record[clientHelloRecordHeaderSize:])
+	return sni, br, err
+}
+
+// parseClientHelloSNI extracts the server_name extension from the handshake
+// body of a (single-record) ClientHello message.
+func parseClientHelloSNI(hs []byte) (string, error) {
+	if len(hs) < 4 || hs[0] != 0x01 {
+		return "", errors.New("clienthello: not a ClientHello")
+	}
+	p := hs[4:]
+	if len(p) < 34 { // client_version(2) + random(32)
+		return "", io.ErrUnexpectedEOF
+	}
+	p = p[34:]
+
+	p, err := skipLengthPrefixed(p, 1) // session_id
+	if err != nil {
+		return "", err
+	}
+	p, err = skipLengthPrefixed(p, 2) // cipher_suites
+	if err != nil {
+		return "", err
+	}
+	p, err = skipLengthPrefixed(p, 1) // compression_methods
+	if err != nil {
+		return "", err
+	}
+
+	if len(p) < 2 {
+		return "", errNoSNI // no extensions at all
+	}
+	extLen := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) < extLen {
+		return "", io.ErrUnexpectedEOF
+	}
+	p = p[:extLen]
+
+	for len(p) >= 4 {
+		extType := binary.BigEndian.Uint16(p)
+		l := int(binary.BigEndian.Uint16(p[2:]))
+		p = p[4:]
+		if len(p) < l {
+			return "", io.ErrUnexpectedEOF
+		}
+		if extType == 0x0000 {
+			return parseServerNameExtension(p[:l])
+		}
+		p = p[l:]
+	}
+	return "", errNoSNI
+}
+
+func parseServerNameExtension(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", errNoSNI
+	}
+	listLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < listLen {
+		return "", io.ErrUnexpectedEOF
+	}
+	data = data[:listLen]
+	for len(data) >= 3 {
+		nameType := data[0]
+		nameLen := int(binary.BigEndian.Uint16(data[1:3]))
+		data = data[3:]
+		if len(data) < nameLen {
+			return "", io.ErrUnexpectedEOF
+		}
+		if nameType == 0 { // host_name
+			return string(data[:nameLen]), nil
+		}
+		data = data[nameLen:]
+	}
+	return "", errNoSNI
+}
+
+// skipLengthPrefixed consumes a field of the form <prefixLen bytes of
+// length><data> and returns the remainder of p.
+func skipLengthPrefixed(p []byte, prefixLen int) ([]byte, error) {
+	if len(p) < prefixLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var l int
+	switch prefixLen {
+	case 1:
+		l = int(p[0])
+	case 2:
+		l = int(binary.BigEndian.Uint16(p))
+	default:
+		return nil, errors.New("clienthello: unsupported length prefix")
+	}
+	p = p[prefixLen:]
+	if len(p) < l {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return p[l:], nil
+}
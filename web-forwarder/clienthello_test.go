@@ -0,0 +1,116 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// buildClientHello assembles a minimal TLS record carrying a ClientHello
+// handshake message, with a server_name extension when sni != "", plus
+// padding bytes added via an opaque extra extension to pad the record past
+// a chosen size (used to exercise the >4KB buffer-sizing fix).
+func buildClientHello(sni string, padTo int) []byte {
+	var hs bytes.Buffer
+	hs.Write(make([]byte, 2))  // client_version
+	hs.Write(make([]byte, 32)) // random
+	hs.WriteByte(0)            // session_id length
+	binary.Write(&hs, binary.BigEndian, uint16(2))
+	hs.Write([]byte{0x00, 0x00}) // one cipher suite
+	hs.WriteByte(1)              // compression_methods length
+	hs.WriteByte(0)
+
+	var exts bytes.Buffer
+	if sni != "" {
+		var name bytes.Buffer
+		name.WriteByte(0) // host_name
+		binary.Write(&name, binary.BigEndian, uint16(len(sni)))
+		name.WriteString(sni)
+
+		var sniExt bytes.Buffer
+		binary.Write(&sniExt, binary.BigEndian, uint16(name.Len()))
+		sniExt.Write(name.Bytes())
+
+		binary.Write(&exts, binary.BigEndian, uint16(0)) // extension type server_name
+		binary.Write(&exts, binary.BigEndian, uint16(sniExt.Len()))
+		exts.Write(sniExt.Bytes())
+	}
+	if padTo > 0 {
+		for exts.Len() < padTo {
+			binary.Write(&exts, binary.BigEndian, uint16(0xff00)) // unknown extension type
+			binary.Write(&exts, binary.BigEndian, uint16(1))      // length 1
+			exts.WriteByte(0)
+		}
+	}
+	binary.Write(&hs, binary.BigEndian, uint16(exts.Len()))
+	hs.Write(exts.Bytes())
+
+	var handshake bytes.Buffer
+	handshake.WriteByte(0x01) // ClientHello
+	handshake.WriteByte(byte(hs.Len() >> 16))
+	handshake.WriteByte(byte(hs.Len() >> 8))
+	handshake.WriteByte(byte(hs.Len()))
+	handshake.Write(hs.Bytes())
+
+	var record bytes.Buffer
+	record.WriteByte(0x16)     // handshake record
+	record.Write([]byte{3, 3}) // TLS 1.2 (legacy record version)
+	binary.Write(&record, binary.BigEndian, uint16(handshake.Len()))
+	record.Write(handshake.Bytes())
+	return record.Bytes()
+}
+
+func TestPeekSNIExtractsServerName(t *testing.T) {
+	raw := buildClientHello("example.com", 0)
+	sni, replay, err := peekSNI(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "example.com" {
+		t.Fatalf("sni = %q, want %q", sni, "example.com")
+	}
+	replayed, err := io.ReadAll(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replayed, raw) {
+		t.Fatal("replay must reproduce the original ClientHello bytes")
+	}
+}
+
+func TestPeekSNINoExtension(t *testing.T) {
+	raw := buildClientHello("", 0)
+	_, _, err := peekSNI(bytes.NewReader(raw))
+	if !errors.Is(err, errNoSNI) {
+		t.Fatalf("err = %v, want errNoSNI", err)
+	}
+}
+
+func TestPeekSNIOversizedRecord(t *testing.T) {
+	// Padded past the old fixed 4096-byte bufio buffer; must still parse
+	// rather than failing with bufio.ErrBufferFull.
+	raw := buildClientHello("example.com", 8000)
+	sni, _, err := peekSNI(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "example.com" {
+		t.Fatalf("sni = %q, want %q", sni, "example.com")
+	}
+}
@@ -17,11 +17,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -39,57 +37,55 @@ import (
 func main() {
 	var localAddr *net.TCPAddr
 	pathToFile := kingpin.Flag("acl", "Path to Path-based Access Control List").Default("").String()
+	routerConfig := kingpin.Flag("router-config",
+		"Path to SNI routing table; when set, routes each session to a backend "+
+			"selected by the ClientHello's SNI instead of a single fixed backend").
+		Default("").String()
+	proxyProtocol := kingpin.Flag("proxy-protocol",
+		"Prepend a PROXY protocol header carrying the client's SCION endpoint to "+
+			"the backend connection. Supported values: \"v2\"").
+		Default("").String()
 	kingpin.Flag("addr", "Local addr to translate to SCION").Required().TCPVar(&localAddr)
 	kingpin.Parse()
 
+	if *proxyProtocol != "" && *proxyProtocol != "v2" {
+		fmt.Fprintf(os.Stderr, "ERROR: unsupported --proxy-protocol %q\n", *proxyProtocol)
+		os.Exit(2)
+	}
+
 	logCfg := slog.Config{Console: slog.ConsoleConfig{Level: "debug"}}
 	if err := slog.Setup(logCfg); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
 		os.Exit(2)
 	}
 
-	acl, err := readACL(*pathToFile)
+	acl, err := pan.LoadACL(*pathToFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
 		os.Exit(2)
 	}
 
-	// Proxy HTTPS, forward the entire TLS traffic data
-	log.Fatalf("%s", forwardTLS(localAddr.String(), acl))
-}
-
-func readACL(pathToFile string) ([]pan.PathFingerprint, error) {
-	if pathToFile == "" {
-		slog.Info("WARNING: Not ACL file provided. Accepting any paths...")
-		return nil, nil
-	}
-	file, err := os.Open(pathToFile)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	rawFile, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, err
-	}
-	var acl map[string][]pan.PathFingerprint
-	err = json.Unmarshal(rawFile, &acl)
-	if err != nil {
-		return nil, err
+	var router *Router
+	if *routerConfig != "" {
+		router, err = NewRouter(*routerConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(2)
+		}
 	}
-	slog.Info("read ACL on", "pathToFile", pathToFile)
-	slog.Debug("ACL", "paths", acl["paths"])
-	return acl["paths"], nil
+
+	// Proxy HTTPS, forward the entire TLS traffic data
+	log.Fatalf("%s", forwardTLS(localAddr.String(), acl, router, *proxyProtocol == "v2"))
 }
 
 // forwardTLS listens on 443 and forwards each sessions to the corresponding
 // TCP/IP host identified by SNI
-func forwardTLS(addrStr string, acl []pan.PathFingerprint) error {
+func forwardTLS(addrStr string, acl *pan.ACL, router *Router, proxyProtocolV2 bool) error {
 	addr, err := netaddr.ParseIPPort(addrStr)
 	if err != nil {
 		return err
 	}
-	listener, err := listen(addr, acl)
+	listener, err := listen(addr)
 	fmt.Printf("server listenning on:  %v\n", listener.Addr())
 	if err != nil {
 		return err
@@ -99,30 +95,117 @@ func forwardTLS(addrStr string, acl []pan.PathFingerprint) error {
 		if err != nil {
 			return err
 		}
-		go forwardTLSSession(sess)
+		go forwardTLSSession(sess, acl, router, proxyProtocolV2)
 	}
 
 }
 
-// forwardTLS forwards traffic for sess to the corresponding TCP/IP host
-// identified by SNI.
-func forwardTLSSession(sess quic.Session) {
+// forwardTLSSession forwards traffic for sess to the corresponding TCP/IP
+// host. acl is checked first against sess's SCION endpoint, same as before
+// the listener stopped enforcing it itself (see listen). With no router,
+// every session that passes acl goes to the single fixed backend
+// 127.0.0.1:443, as before. With a router, the ClientHello's SNI is peeked
+// off the stream (without terminating TLS) and used to pick a backend and
+// its own route-level ACL (an SNI that matches no route goes to the
+// default route, if one is configured); sessions with no SNI extension, an
+// SNI that matches no route and no default route, or one that arrived on a
+// path that acl or the matched route's ACL doesn't allow, are rejected with
+// a 421-style logged status.
+func forwardTLSSession(sess quic.Session, acl *pan.ACL, router *Router, proxyProtocolV2 bool) {
+	if !pathAllowed(sess.RemoteAddr(), acl) {
+		logForwardTLS(sess.RemoteAddr(), 421)
+		_ = sess.CloseWithError(421, "path not allowed")
+		return
+	}
+
 	clientConn, err := quicutil.NewSingleStream(sess)
 	if err != nil {
 		return
 	}
-	dstConn, err := net.Dial("tcp", "127.0.0.1:443")
+
+	if router == nil {
+		forwardToBackend(sess, clientConn, Route{Backend: "127.0.0.1:443"}, proxyProtocolV2)
+		return
+	}
+
+	sni, replay, err := peekSNI(clientConn)
+	if err != nil {
+		if errors.Is(err, errNoSNI) {
+			logForwardTLS(sess.RemoteAddr(), 421)
+			_ = sess.CloseWithError(421, "no SNI extension")
+		} else {
+			logForwardTLS(sess.RemoteAddr(), 400)
+			_ = sess.CloseWithError(400, "could not parse ClientHello")
+		}
+		return
+	}
+	route, ok := router.Route(sni)
+	if !ok {
+		logForwardTLS(sess.RemoteAddr(), 421)
+		_ = sess.CloseWithError(421, "no backend for SNI "+sni)
+		return
+	}
+	if !pathAllowed(sess.RemoteAddr(), route.acl) {
+		logForwardTLS(sess.RemoteAddr(), 421)
+		_ = sess.CloseWithError(421, "path not allowed for this route")
+		return
+	}
+	forwardToBackend(sess, replayConn{replay, clientConn}, *route, proxyProtocolV2)
+}
+
+// forwardToBackend dials route.Backend and pipes clientConn to/from it. When
+// proxyProtocolV2 is set, a PROXY protocol v2 header carrying sess's SCION
+// endpoint is written to the raw TCP connection before it's wrapped in TLS
+// (for route.BackendTLS) -- a PROXY-v2-aware backend expects that header as
+// the TCP preamble, before TLS is even negotiated, not as the first bytes
+// of the established TLS stream.
+func forwardToBackend(sess quic.Session, clientConn io.ReadWriteCloser, route Route, proxyProtocolV2 bool) {
+	rawConn, err := net.Dial("tcp", route.Backend)
 	if err != nil {
 		logForwardTLS(sess.RemoteAddr(), 503)
 		_ = sess.CloseWithError(503, "service unavailable")
 		return
 	}
+	if proxyProtocolV2 {
+		if err := writeProxyProtocolV2(rawConn, sess); err != nil {
+			slog.Error("failed to write PROXY protocol v2 header", "err", err)
+			_ = rawConn.Close()
+			logForwardTLS(sess.RemoteAddr(), 502)
+			_ = sess.CloseWithError(502, "bad gateway")
+			return
+		}
+	}
+
+	var dstConn net.Conn = rawConn
+	if route.BackendTLS {
+		dstConn = tls.Client(rawConn, &tls.Config{ServerName: hostOf(route.Backend)})
+	}
 
 	logForwardTLS(sess.RemoteAddr(), 200)
 	go transfer(dstConn, clientConn)
 	transfer(clientConn, dstConn)
 }
 
+func hostOf(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// replayConn reads from a buffered reader that starts with the bytes
+// peeked off of rwc (so the ClientHello is replayed unchanged) and then
+// continues reading from rwc; writes and closes go straight to rwc.
+type replayConn struct {
+	r   io.Reader
+	rwc io.ReadWriteCloser
+}
+
+func (c replayConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c replayConn) Write(p []byte) (int, error) { return c.rwc.Write(p) }
+func (c replayConn) Close() error                { return c.rwc.Close() }
+
 // logForwardTLS logs TLS forwarding in something similar to the Common Log
 // Format, as used by the LoggingHandler above.
 // Status is a code that is part to the log line. This is not HTTP, but we
@@ -158,10 +241,14 @@ func transfer(dst io.WriteCloser, src io.ReadCloser) {
 	}
 }
 
-func listen(laddr netaddr.IPPort, allowedPaths []pan.PathFingerprint) (quic.Listener, error) {
+// listen opens the QUIC listener with no path ACL of its own: path
+// filtering is now done by forwardTLSSession via pan.ACL, which (unlike
+// the flat fingerprint list this used to pass in here) can express deny
+// rules, ISD-wide allows and per-route ACLs.
+func listen(laddr netaddr.IPPort) (quic.Listener, error) {
 	tlsCfg := &tls.Config{
 		NextProtos:   []string{quicutil.SingleStreamProto},
 		Certificates: quicutil.MustGenerateSelfSignedCert(),
 	}
-	return pan.ListenQUIC(context.Background(), laddr, nil, allowedPaths, tlsCfg, nil)
+	return pan.ListenQUIC(context.Background(), laddr, nil, nil, tlsCfg, nil)
 }
@@ -0,0 +1,40 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/netsec-ethz/scion-apps/pkg/quicutil"
+)
+
+// writeProxyProtocolV2 prepends a PROXY protocol v2 header to dst, carrying
+// sess's original SCION endpoint (IA, forwarding path fingerprint and
+// textual address) in custom TLVs. This lets a PROXY-v2-aware backend
+// (nginx, HAProxy with a Lua unpacker) recover the real client identity
+// even though dst only sees a loopback TCP socket.
+func writeProxyProtocolV2(dst net.Conn, sess quic.Session) error {
+	// The synthetic address block is only there to keep AF-agnostic PROXY
+	// v2 parsers happy; the real identity travels in the TLVs, so we don't
+	// bother trying to recover SCION "ports" (which don't really exist).
+	hdr, err := quicutil.BuildProxyProtocolV2(sess.RemoteAddr(), 0, 0)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(hdr)
+	return err
+}
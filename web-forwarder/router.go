@@ -0,0 +1,194 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	slog "github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/snet"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+)
+
+// Route describes a single SNI-matched backend.
+type Route struct {
+	// Pattern is matched against the ClientHello's SNI using shell-style
+	// globbing, e.g. "*.example.com". The default route (see RouterConfig)
+	// has no pattern and is only reached when nothing else matches.
+	Pattern string `json:"pattern"`
+	// Backend is the "host:port" this route forwards to.
+	Backend string `json:"backend"`
+	// BackendTLS indicates that Backend itself expects TLS, so the router
+	// should dial it with crypto/tls instead of a plain TCP socket.
+	BackendTLS bool `json:"backend_tls"`
+	// ACLRules and ACLDefault describe this route's ACL, evaluated with
+	// pan.ACL/pan.NewACL the same way the global --acl flag is (see
+	// main.go); a nil ACLRules with no ACLDefault accepts any path,
+	// matching the old "AllowedPaths" field's empty-list behaviour.
+	ACLRules   []pan.ACLRule `json:"acl_rules,omitempty"`
+	ACLDefault pan.ACLAction `json:"acl_default,omitempty"`
+
+	// acl is ACLRules/ACLDefault, compiled by loadRouterConfig.
+	acl *pan.ACL
+}
+
+// RouterConfig is the on-disk representation of the SNI routing table.
+type RouterConfig struct {
+	Routes  []Route `json:"routes"`
+	Default *Route  `json:"default"`
+}
+
+func loadRouterConfig(pathToFile string) (*RouterConfig, error) {
+	raw, err := os.ReadFile(pathToFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfg RouterConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].compileACL(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Default != nil {
+		if err := cfg.Default.compileACL(); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+// compileACL builds route.acl from its ACLRules/ACLDefault, if any were
+// configured; a route with neither accepts any path, same as before this
+// was migrated onto pan.ACL.
+func (route *Route) compileACL() error {
+	if len(route.ACLRules) == 0 && route.ACLDefault == "" {
+		return nil
+	}
+	acl, err := pan.NewACL(route.ACLRules, route.ACLDefault)
+	if err != nil {
+		return err
+	}
+	route.acl = acl
+	return nil
+}
+
+// match returns the route for sni, falling back to cfg.Default if no
+// pattern matches. An exact (non-glob) pattern always takes priority over a
+// glob, regardless of declaration order -- otherwise an earlier catch-all
+// like "*.example.com" would silently shadow a later, more specific route
+// for "api.example.com". Among routes of the same specificity, declaration
+// order still decides. ok is false if there is neither a matching route
+// nor a default, in which case the caller should reject the request.
+func (cfg *RouterConfig) match(sni string) (route *Route, ok bool) {
+	if sni != "" {
+		for i := range cfg.Routes {
+			r := &cfg.Routes[i]
+			if r.Pattern == sni {
+				return r, true
+			}
+		}
+		for i := range cfg.Routes {
+			r := &cfg.Routes[i]
+			if matched, _ := path.Match(r.Pattern, sni); matched {
+				return r, true
+			}
+		}
+	}
+	if cfg.Default != nil {
+		return cfg.Default, true
+	}
+	return nil, false
+}
+
+// Router holds the current RouterConfig and reloads it from disk whenever
+// the process receives SIGHUP.
+type Router struct {
+	pathToFile string
+
+	mu  sync.RWMutex
+	cfg *RouterConfig
+}
+
+// NewRouter loads the routing table from pathToFile and starts watching for
+// SIGHUP to reload it.
+func NewRouter(pathToFile string) (*Router, error) {
+	cfg, err := loadRouterConfig(pathToFile)
+	if err != nil {
+		return nil, err
+	}
+	router := &Router{pathToFile: pathToFile, cfg: cfg}
+	go router.watchReload()
+	return router, nil
+}
+
+func (router *Router) watchReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		cfg, err := loadRouterConfig(router.pathToFile)
+		if err != nil {
+			slog.Error("router: failed to reload config, keeping previous", "err", err)
+			continue
+		}
+		router.mu.Lock()
+		router.cfg = cfg
+		router.mu.Unlock()
+		slog.Info("router: reloaded config", "pathToFile", router.pathToFile, "routes", len(cfg.Routes))
+	}
+}
+
+// Route returns the backend route for a given SNI, if any.
+func (router *Router) Route(sni string) (*Route, bool) {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+	return router.cfg.match(sni)
+}
+
+// scionRemote is implemented by the remote addresses pan hands out for
+// SCION/QUIC sessions; it lets us recover the source ISD-AS/host and the
+// PathFingerprint the session actually arrived on so an ACL can be
+// evaluated against it.
+type scionRemote interface {
+	Fingerprint() pan.PathFingerprint
+	IA() addr.IA
+	IP() net.IP
+}
+
+// pathAllowed reports whether remote is allowed by acl. A nil acl accepts
+// any path; a remote address that carries no SCION path information (e.g.
+// the client connected directly within the same AS) is always accepted,
+// matching the behaviour of the previous flat-fingerprint-list ACL.
+func pathAllowed(remote net.Addr, acl *pan.ACL) bool {
+	if acl == nil {
+		return true
+	}
+	sr, ok := remote.(scionRemote)
+	if !ok {
+		return true
+	}
+	src := snet.SCIONAddress{IA: sr.IA(), Host: addr.HostFromIP(sr.IP())}
+	return acl.Match(src, sr.Fingerprint(), nil)
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestRouterConfigMatch(t *testing.T) {
+	cfg := &RouterConfig{
+		Routes: []Route{
+			{Pattern: "*.example.com", Backend: "10.0.0.1:443"},
+			{Pattern: "api.example.com", Backend: "10.0.0.2:443"},
+		},
+		Default: &Route{Backend: "10.0.0.9:443"},
+	}
+
+	cases := []struct {
+		sni     string
+		backend string
+		ok      bool
+	}{
+		{"api.example.com", "10.0.0.2:443", true}, // exact match wins over the earlier glob
+		{"foo.example.com", "10.0.0.1:443", true}, // glob match
+		{"unknown.test", "10.0.0.9:443", true},    // falls back to default
+		{"", "10.0.0.9:443", true},                // no SNI also falls back to default
+	}
+	for _, c := range cases {
+		route, ok := cfg.match(c.sni)
+		if ok != c.ok {
+			t.Errorf("match(%q) ok = %v, want %v", c.sni, ok, c.ok)
+			continue
+		}
+		if ok && route.Backend != c.backend {
+			t.Errorf("match(%q) backend = %q, want %q", c.sni, route.Backend, c.backend)
+		}
+	}
+}
+
+func TestRouterConfigMatchNoDefault(t *testing.T) {
+	cfg := &RouterConfig{Routes: []Route{{Pattern: "*.example.com", Backend: "10.0.0.1:443"}}}
+	if _, ok := cfg.match("unknown.test"); ok {
+		t.Error("with no default route, an unmatched SNI should be rejected")
+	}
+}